@@ -0,0 +1,427 @@
+package repository
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/crypto"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/restic"
+)
+
+// Cache is implemented by caches that can tell whether they already hold a
+// copy of a given file.
+type Cache interface {
+	Has(h backend.Handle) bool
+}
+
+// Repository is a high-level repository backed by a raw backend.
+type Repository struct {
+	be  backend.Backend
+	key *crypto.Key
+
+	Cache Cache
+}
+
+// ScheduleOptions customizes the scoring schedulePacks uses to order pack
+// downloads.
+type ScheduleOptions struct {
+	// LatencyHints estimates the backend round-trip latency for fetching a
+	// given pack, keyed by PackID. Packs with a larger hint are scheduled
+	// earlier so that their round trip overlaps with the download/decode of
+	// packs scheduled after them. Packs with no entry are treated as having
+	// no extra latency.
+	LatencyHints map[restic.ID]time.Duration
+
+	// IgnoreSize disables scoring by pack size (and, transitively,
+	// LatencyHints): within a cache-status group, packs keep their original
+	// relative order instead of being ordered smaller-first. Used by
+	// sortCachedPacksFirst, which only wants the cached/uncached partition.
+	IgnoreSize bool
+}
+
+// latencyAsBytes converts a latency hint into the same units as pack size,
+// so the two can be combined into a single score.
+func latencyAsBytes(latency time.Duration) int64 {
+	const bytesPerMillisecond = 1 << 20 / 10 // 10ms of latency ~ 1MB of transfer
+	return int64(latency/time.Millisecond) * bytesPerMillisecond
+}
+
+// schedulePacks orders blobs so that restore/check visit packs in an order
+// that keeps downloads flowing: all blobs belonging to the same pack are
+// grouped and kept contiguous (in their original relative order), cached
+// packs are scheduled before uncached ones, and within a cache-status group
+// smaller packs are scheduled before larger ones - so a single large cached
+// pack doesn't get to stall the worker pool behind several small ones. If
+// opts.LatencyHints is set, a pack's estimated latency is subtracted from its
+// effective size, moving packs on slow backends earlier so their round trip
+// overlaps with other work. Ordering is stable: packs of equal score keep
+// their original relative order.
+func schedulePacks(cache Cache, blobs []restic.PackedBlob, opts ScheduleOptions) []restic.PackedBlob {
+	if len(blobs) == 0 {
+		return blobs
+	}
+
+	type group struct {
+		packID restic.ID
+		cached bool
+		size   int64
+		blobs  []restic.PackedBlob
+	}
+
+	groups := make(map[restic.ID]*group, len(blobs))
+	order := make([]restic.ID, 0, len(blobs))
+	for _, blob := range blobs {
+		g, ok := groups[blob.PackID]
+		if !ok {
+			h := backend.Handle{Type: backend.PackFile, Name: blob.PackID.String()}
+			g = &group{packID: blob.PackID, cached: cache != nil && cache.Has(h)}
+			groups[blob.PackID] = g
+			order = append(order, blob.PackID)
+		}
+		g.size += int64(blob.Length)
+		g.blobs = append(g.blobs, blob)
+	}
+
+	sortedGroups := make([]*group, len(order))
+	for i, id := range order {
+		sortedGroups[i] = groups[id]
+	}
+
+	cost := func(g *group) int64 {
+		if opts.IgnoreSize {
+			return 0
+		}
+		c := g.size
+		if opts.LatencyHints != nil {
+			c -= latencyAsBytes(opts.LatencyHints[g.packID])
+		}
+		return c
+	}
+
+	sort.SliceStable(sortedGroups, func(i, j int) bool {
+		gi, gj := sortedGroups[i], sortedGroups[j]
+		if gi.cached != gj.cached {
+			return gi.cached
+		}
+		return cost(gi) < cost(gj)
+	})
+
+	result := make([]restic.PackedBlob, 0, len(blobs))
+	for _, g := range sortedGroups {
+		result = append(result, g.blobs...)
+	}
+	return result
+}
+
+// sortCachedPacksFirst moves all cached pack files to the front of blobs.
+// It's a thin wrapper around schedulePacks, kept for callers that only need
+// the cached/uncached split and don't care about size or latency: it sets
+// IgnoreSize so packs within each cache-status group keep the relative order
+// of their first blob. As in schedulePacks, blobs of the same pack are
+// gathered into one contiguous run, so the result is a pure stable partition
+// only when the blobs of each pack are already contiguous in blobs.
+func sortCachedPacksFirst(cache Cache, blobs []restic.PackedBlob) {
+	if cache == nil {
+		return
+	}
+
+	copy(blobs, schedulePacks(cache, blobs, ScheduleOptions{IgnoreSize: true}))
+}
+
+// defaultStreamPackGapBytes is used by streamPack when
+// StreamPackOptions.MaxGapBytes is left at its zero value, and is the upper
+// bound of what Repository.StreamPack derives for it. It was chosen empirically: it's small enough that a
+// merged read over local-disk or LAN backends doesn't waste much bandwidth,
+// but large enough to absorb the gaps a typical restore/check blob selection
+// leaves between wanted blobs in a pack.
+const defaultStreamPackGapBytes = 4 * 1024 * 1024
+
+// StreamPackOptions controls how streamPack groups blob reads into backend
+// load calls.
+type StreamPackOptions struct {
+	// MaxGapBytes is the largest gap between two requested blobs that may be
+	// bridged by a single load call. Gaps larger than this cause streamPack
+	// to issue separate load calls instead of reading (and discarding) the
+	// bytes in between. A zero value selects defaultStreamPackGapBytes in
+	// streamPack; Repository.StreamPack instead derives it from the
+	// backend's number of connections (see
+	// streamPackGapBytesForConnections).
+	MaxGapBytes int
+
+	// WorkerCount sets how many blobs are decrypted and decompressed
+	// concurrently within a single run. A zero value selects
+	// runtime.GOMAXPROCS(0). Tests pin this to 1 for deterministic
+	// behavior.
+	WorkerCount int
+}
+
+type backendLoadFn func(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error
+
+// streamPack loads the listed blobs from the pack denoted by packID via
+// beLoad, decrypts them and calls handleBlobFn with the plaintext of each.
+// Adjacent blobs - and blobs separated by a gap no larger than
+// opts.MaxGapBytes - are fetched using a single backend request to amortize
+// per-request overhead.
+func streamPack(ctx context.Context, beLoad backendLoadFn, key *crypto.Key, packID restic.ID, blobs []restic.Blob, opts StreamPackOptions, handleBlobFn func(blob restic.BlobHandle, buf []byte, err error) error) error {
+	if len(blobs) == 0 {
+		// nothing to do
+		return nil
+	}
+
+	maxGapBytes := opts.MaxGapBytes
+	if maxGapBytes <= 0 {
+		maxGapBytes = defaultStreamPackGapBytes
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Offset < blobs[j].Offset
+	})
+
+	lastBlobEnd := blobs[0].Offset
+	for _, blob := range blobs {
+		if blob.Offset < lastBlobEnd {
+			debug.Log("pack %v: blob %v overlaps with previous blob", packID, blob.ID)
+			return errors.Errorf("overlapping blobs in pack %v", packID)
+		}
+		lastBlobEnd = blob.Offset + blob.Length
+	}
+
+	// group the sorted blobs into runs that are fetched via a single load
+	// call each: start a new run whenever the gap to the previous blob
+	// exceeds maxGapBytes.
+	runs := [][]restic.Blob{{blobs[0]}}
+	for _, blob := range blobs[1:] {
+		cur := runs[len(runs)-1]
+		gap := int(blob.Offset) - int(cur[len(cur)-1].Offset+cur[len(cur)-1].Length)
+		if gap > maxGapBytes {
+			runs = append(runs, []restic.Blob{blob})
+		} else {
+			runs[len(runs)-1] = append(cur, blob)
+		}
+	}
+
+	workers := opts.WorkerCount
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	h := backend.Handle{Type: backend.PackFile, Name: packID.String()}
+
+	for _, run := range runs {
+		dataStart := run[0].Offset
+		dataEnd := run[len(run)-1].Offset + run[len(run)-1].Length
+
+		err := beLoad(ctx, h, int(dataEnd-dataStart), int64(dataStart), func(rd io.Reader) error {
+			return decryptRun(ctx, rd, dataStart, key, run, workers, handleBlobFn)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decryptRun reads the entire byte range covered by run from rd (which
+// begins at runStart) into memory, then decrypts and decompresses run's
+// blobs using a pool of workers workers goroutines, delivering the results
+// to handleBlobFn in the order the blobs appear in run. Bytes between blobs
+// (coalesced gaps) are read but discarded. The whole range is buffered up
+// front so that a short read - which the caller retries by invoking
+// decryptRun again on a fresh reader - doesn't result in handleBlobFn being
+// called twice for blobs that were already delivered before the short read
+// was detected.
+//
+// If handleBlobFn returns an error, the context passed to the worker pool is
+// canceled so that outstanding work is abandoned, and the first such error
+// is returned; this includes a *backoff.PermanentError, which the caller's
+// beLoad is expected to propagate without retrying. If ctx is canceled before
+// every blob of run has been delivered, ctx's error is returned.
+func decryptRun(ctx context.Context, rd io.Reader, runStart uint, key *crypto.Key, run []restic.Blob, workers int, handleBlobFn func(blob restic.BlobHandle, buf []byte, err error) error) error {
+	runEnd := run[len(run)-1].Offset + run[len(run)-1].Length
+	buf := make([]byte, runEnd-runStart)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		return errors.Wrap(err, "ReadFull")
+	}
+
+	if workers > len(run) {
+		workers = len(run)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type job struct {
+		idx  int
+		blob restic.Blob
+		ct   []byte
+	}
+	type result struct {
+		idx       int
+		plaintext []byte
+		err       error
+	}
+
+	jobs := make(chan job, workers)
+	results := make(chan result, workers)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				plaintext, err := decryptBlob(key, j.blob, j.ct)
+				select {
+				case results <- result{j.idx, plaintext, err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for i, blob := range run {
+			start := blob.Offset - runStart
+			select {
+			case jobs <- job{i, blob, buf[start : start+blob.Length]}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// reorder buffer: blobs may finish decrypting out of submission order,
+	// but handleBlobFn must see them in run order. Stop delivering as soon as
+	// handleBlobFn returns an error, matching streamPack's pre-pipeline
+	// behavior of aborting at the first error instead of draining the rest
+	// of the run.
+	pending := make(map[int]result, workers)
+	next := 0
+	var retErr error
+deliver:
+	for res := range results {
+		pending[res.idx] = res
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+
+			if err := handleBlobFn(run[r.idx].BlobHandle, r.plaintext, r.err); err != nil {
+				retErr = err
+				cancel()
+				break deliver
+			}
+		}
+	}
+
+	if retErr == nil && next < len(run) {
+		// workers stopped early because the parent context was canceled
+		retErr = ctx.Err()
+	}
+
+	return retErr
+}
+
+// nonceSize is the size, in bytes, of the nonce prepended to every blob's
+// ciphertext.
+const nonceSize = 16
+
+// decryptBlob decrypts (and, for compressed blobs, decompresses) a single
+// blob's ciphertext as read from the pack file.
+func decryptBlob(key *crypto.Key, blob restic.Blob, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) <= nonceSize {
+		return nil, errors.Errorf("invalid blob length %v for blob %v", len(ciphertext), blob.ID)
+	}
+
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	plaintext, err := key.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.Errorf("ciphertext verification failed for blob %v: %v", blob.ID, err)
+	}
+
+	if blob.UncompressedLength != 0 {
+		plaintext, err = decompress(plaintext, int(blob.UncompressedLength))
+		if err != nil {
+			return nil, errors.Wrap(err, "decompress")
+		}
+	}
+
+	id := restic.Hash(plaintext)
+	if !id.Equal(blob.ID) {
+		return nil, errors.Errorf("blob %v returned invalid hash %v", blob.ID, id)
+	}
+
+	return plaintext, nil
+}
+
+var zstdDecoderPool = sync.Pool{
+	New: func() interface{} {
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			panic(err)
+		}
+		return dec
+	},
+}
+
+// decompress decodes zstd-compressed data, using uncompressedLength (known
+// from the blob's index entry) to preallocate the output buffer.
+func decompress(data []byte, uncompressedLength int) ([]byte, error) {
+	dec := zstdDecoderPool.Get().(*zstd.Decoder)
+	defer zstdDecoderPool.Put(dec)
+	return dec.DecodeAll(data, make([]byte, 0, uncompressedLength))
+}
+
+// StreamPack loads the given blobs from the pack identified by packID and
+// calls handleBlobFn for each plaintext blob, in no particular order. opts
+// lets callers such as restore and check tune how aggressively adjacent
+// reads are coalesced; a zero-value StreamPackOptions picks sensible
+// defaults based on the repository's backend.
+func (r *Repository) StreamPack(ctx context.Context, packID restic.ID, blobs []restic.Blob, opts StreamPackOptions, handleBlobFn func(blob restic.BlobHandle, buf []byte, err error) error) error {
+	if opts.MaxGapBytes <= 0 {
+		opts.MaxGapBytes = streamPackGapBytesForConnections(r.be.Connections())
+	}
+
+	loadFn := func(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+		return r.be.Load(ctx, h, length, offset, fn)
+	}
+
+	return streamPack(ctx, loadFn, r.key, packID, blobs, opts, handleBlobFn)
+}
+
+// streamPackGapBytesForConnections derives a default MaxGapBytes from the
+// number of concurrent connections a backend supports. decryptRun reads and
+// discards every gap byte, so the result is always capped at
+// defaultStreamPackGapBytes - a genuinely small gap - regardless of
+// connections; backends with few connections benefit more from coalescing
+// requests, since every extra round-trip competes for a scarce connection,
+// so they get the full default instead of a further-reduced one.
+func streamPackGapBytesForConnections(connections uint) int {
+	switch {
+	case connections <= 2:
+		return defaultStreamPackGapBytes
+	case connections <= 8:
+		return defaultStreamPackGapBytes / 2
+	default:
+		return defaultStreamPackGapBytes / 4
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"math/rand"
 	"sort"
@@ -84,6 +85,56 @@ func BenchmarkSortCachedPacksFirst(b *testing.B) {
 	}
 }
 
+// BenchmarkSchedulePacks uses a realistic mix of pack sizes (many small
+// packs alongside a handful of large ones, as produced by a typical restic
+// prune/repack) to exercise schedulePacks' grouping and scoring.
+func BenchmarkSchedulePacks(b *testing.B) {
+	const npacks = 200
+
+	var (
+		cache = make(mapcache)
+		r     = rand.New(rand.NewSource(1261))
+		blobs []restic.PackedBlob
+	)
+
+	for i := 0; i < npacks; i++ {
+		var id restic.ID
+		r.Read(id[:])
+
+		// most packs are a few MB, a handful are much larger
+		size := 4*1024*1024 + r.Intn(4*1024*1024)
+		if i%20 == 0 {
+			size = 100 * 1024 * 1024
+		}
+
+		if i%3 == 0 {
+			h := backend.Handle{Name: id.String(), Type: backend.PackFile}
+			cache[h] = true
+		}
+
+		// split each pack into a handful of blobs
+		const nblobsPerPack = 8
+		for j := 0; j < nblobsPerPack; j++ {
+			blobs = append(blobs, restic.PackedBlob{
+				PackID: id,
+				Blob: restic.Blob{
+					Length: uint(size / nblobsPerPack),
+				},
+			})
+		}
+	}
+
+	opts := ScheduleOptions{}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		cpy := make([]restic.PackedBlob, len(blobs))
+		copy(cpy, blobs)
+		schedulePacks(cache, cpy, opts)
+	}
+}
+
 // buildPackfileWithoutHeader returns a manually built pack file without a header.
 func buildPackfileWithoutHeader(blobSizes []int, key *crypto.Key, compress bool) (blobs []restic.Blob, packfile []byte) {
 	opts := []zstd.EOption{
@@ -276,7 +327,7 @@ func testStreamPack(t *testing.T, version uint) {
 
 				loadCalls = 0
 				shortFirstLoad = test.shortFirstLoad
-				err = streamPack(ctx, load, &key, restic.ID{}, test.blobs, handleBlob)
+				err = streamPack(ctx, load, &key, restic.ID{}, test.blobs, StreamPackOptions{WorkerCount: 1}, handleBlob)
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -290,6 +341,42 @@ func testStreamPack(t *testing.T, version uint) {
 	})
 	shortFirstLoad = false
 
+	// verify that MaxGapBytes controls how many adjacent blob requests get
+	// coalesced into a single load call
+	t.Run("gaps", func(t *testing.T) {
+		tests := []struct {
+			blobs       []restic.Blob
+			maxGapBytes int
+			calls       int
+		}{
+			// gap of len(packfileBlobs[1]) bytes between the two requested blobs
+			{[]restic.Blob{packfileBlobs[0], packfileBlobs[2]}, 0, 1},
+			{[]restic.Blob{packfileBlobs[0], packfileBlobs[2]}, int(packfileBlobs[1].Length) - 1, 2},
+			{[]restic.Blob{packfileBlobs[0], packfileBlobs[2]}, int(packfileBlobs[1].Length), 1},
+			// gap spanning the whole rest of the pack file
+			{[]restic.Blob{packfileBlobs[0], packfileBlobs[len(packfileBlobs)-1]}, 0, 2},
+			{[]restic.Blob{packfileBlobs[0], packfileBlobs[len(packfileBlobs)-1]}, len(packfile), 1},
+		}
+
+		for _, test := range tests {
+			t.Run("", func(t *testing.T) {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				handleBlob := func(blob restic.BlobHandle, buf []byte, err error) error {
+					return err
+				}
+
+				loadCalls = 0
+				err = streamPack(ctx, load, &key, restic.ID{}, test.blobs, StreamPackOptions{MaxGapBytes: test.maxGapBytes, WorkerCount: 1}, handleBlob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rtest.Equals(t, test.calls, loadCalls)
+			})
+		}
+	})
+
 	// next, test invalid uses, which should return an error
 	t.Run("invalid", func(t *testing.T) {
 		tests := []struct {
@@ -339,7 +426,7 @@ func testStreamPack(t *testing.T, version uint) {
 					return err
 				}
 
-				err = streamPack(ctx, load, &key, restic.ID{}, test.blobs, handleBlob)
+				err = streamPack(ctx, load, &key, restic.ID{}, test.blobs, StreamPackOptions{WorkerCount: 1}, handleBlob)
 				if err == nil {
 					t.Fatalf("wanted error %v, got nil", test.err)
 				}
@@ -351,3 +438,44 @@ func testStreamPack(t *testing.T, version uint) {
 		}
 	})
 }
+
+// BenchmarkStreamPack measures how the worker pool introduced for blob
+// decrypt/decompress scales with StreamPackOptions.WorkerCount.
+func BenchmarkStreamPack(b *testing.B) {
+	const jsonKey = `{"mac":{"k":"eQenuI8adktfzZMuC8rwdA==","r":"k8cfAly2qQSky48CQK7SBA=="},"encrypt":"MKO9gZnRiQFl8mDUurSDa9NMjiu9MUifUrODTHS05wo="}`
+
+	var key crypto.Key
+	if err := json.Unmarshal([]byte(jsonKey), &key); err != nil {
+		b.Fatal(err)
+	}
+
+	const nblobs = 200
+	blobSizes := make([]int, nblobs)
+	for i := range blobSizes {
+		blobSizes[i] = 64 * 1024
+	}
+
+	packfileBlobs, packfile := buildPackfileWithoutHeader(blobSizes, &key, true)
+
+	load := func(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+		return fn(bytes.NewReader(packfile[offset : offset+int64(length)]))
+	}
+
+	handleBlob := func(blob restic.BlobHandle, buf []byte, err error) error {
+		return err
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				blobs := make([]restic.Blob, len(packfileBlobs))
+				copy(blobs, packfileBlobs)
+				err := streamPack(context.Background(), load, &key, restic.ID{}, blobs, StreamPackOptions{WorkerCount: workers}, handleBlob)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}